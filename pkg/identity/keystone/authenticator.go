@@ -0,0 +1,252 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	tokens2 "github.com/gophercloud/gophercloud/openstack/identity/v2/tokens"
+	tokens3 "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	defaultTokenCacheSize   = 4096
+	defaultTokenCacheMaxTTL = 10 * time.Minute
+)
+
+// Authenticator validates bearer tokens presented to the webhook by asking
+// Keystone whether they are still valid, caching the result behind a
+// tokenCache for up to maxTTL, and never past the token's own expiry, so
+// that busy clusters don't pay for a full Keystone round trip on every
+// TokenReview.
+type Authenticator struct {
+	authURL string
+	client  identityClient
+
+	cache  *tokenCache
+	maxTTL time.Duration
+}
+
+var _ authenticator.Token = &Authenticator{}
+
+func newAuthenticator(authURL string, client identityClient, cacheSize int, maxTTL time.Duration) *Authenticator {
+	if cacheSize <= 0 {
+		cacheSize = defaultTokenCacheSize
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultTokenCacheMaxTTL
+	}
+
+	return &Authenticator{
+		authURL: authURL,
+		client:  client,
+		cache:   newTokenCache(cacheSize),
+		maxTTL:  maxTTL,
+	}
+}
+
+func tokenCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateToken implements authenticator.Token.
+func (a *Authenticator) AuthenticateToken(token string) (user.Info, bool, error) {
+	key := tokenCacheKey(token)
+
+	if cached, ok := a.cache.get(key); ok {
+		return cached.info, cached.valid, nil
+	}
+
+	info, expiresAt, err := a.validateToken(token)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if info == nil {
+		a.cache.add(key, cachedTokenResult{valid: false}, negativeTokenCacheTTL)
+		return nil, false, nil
+	}
+
+	ttl := cacheTTLForToken(expiresAt, a.maxTTL, time.Now())
+	if ttl <= 0 {
+		// The token's own expiry has already passed by the webhook's
+		// clock; don't cache it as valid at all.
+		return info, true, nil
+	}
+
+	a.cache.add(key, cachedTokenResult{info: info, valid: true}, ttl)
+	return info, true, nil
+}
+
+// cacheTTLForToken returns how long a successfully validated token may stay
+// cached as valid: min(expiresAt-now, maxTTL). A non-positive result means
+// the token must not be cached as valid at all.
+func cacheTTLForToken(expiresAt time.Time, maxTTL time.Duration, now time.Time) time.Duration {
+	until := expiresAt.Sub(now)
+	if until < maxTTL {
+		return until
+	}
+
+	return maxTTL
+}
+
+func (a *Authenticator) validateToken(token string) (user.Info, time.Time, error) {
+	switch a.client.Version() {
+	case "v3":
+		return validateTokenV3(a.client.ServiceClient(), token)
+	case "v2":
+		return validateTokenV2(a.client.ServiceClient(), token)
+	default:
+		return nil, time.Time{}, fmt.Errorf("unsupported identity API version: %s", a.client.Version())
+	}
+}
+
+func validateTokenV3(client *gophercloud.ServiceClient, token string) (user.Info, time.Time, error) {
+	result := tokens3.Get(client, token)
+
+	tok, err := result.Extract()
+	if err != nil {
+		// The token was rejected by Keystone; that is a negative
+		// authentication result, not an error talking to Keystone.
+		return nil, time.Time{}, nil
+	}
+
+	u, err := result.ExtractUser()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	roles, err := result.ExtractRoles()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	roleNames := make([]string, 0, len(roles))
+	for _, role := range roles {
+		roleNames = append(roleNames, role.Name)
+	}
+
+	extra := map[string][]string{rolesExtraKey: roleNames}
+	if project, err := result.ExtractProject(); err == nil && project != nil {
+		extra[projectIDExtraKey] = []string{project.ID}
+	}
+
+	if idp, groups := extractFederationAttrs(result); idp != "" || len(groups) > 0 {
+		if idp != "" {
+			extra[idpExtraKey] = []string{idp}
+		}
+		if len(groups) > 0 {
+			extra[federatedGroupsExtraKey] = groups
+		}
+	}
+
+	info := &user.DefaultInfo{
+		Name:   u.Name,
+		UID:    u.ID,
+		Groups: roleNames,
+		Extra:  extra,
+	}
+
+	return info, tok.ExpiresAt, nil
+}
+
+// extractFederationAttrs digs the OS-FEDERATION extension out of a token
+// validation response's raw body. gophercloud's tokens3.User does not model
+// this extension, so it is read straight out of the decoded JSON; tokens
+// issued by a plain password/application-credential auth simply lack the
+// key and both return values come back empty.
+func extractFederationAttrs(result tokens3.GetResult) (idp string, groups []string) {
+	body, ok := result.Body.(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+
+	token, ok := body["token"].(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+
+	userBody, ok := token["user"].(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+
+	federation, ok := userBody["OS-FEDERATION"].(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+
+	if idpBody, ok := federation["identity_provider"].(map[string]interface{}); ok {
+		if id, ok := idpBody["id"].(string); ok {
+			idp = id
+		}
+	}
+
+	if groupList, ok := federation["groups"].([]interface{}); ok {
+		for _, g := range groupList {
+			group, ok := g.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if name, ok := group["name"].(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	return idp, groups
+}
+
+func validateTokenV2(client *gophercloud.ServiceClient, token string) (user.Info, time.Time, error) {
+	result := tokens2.Get(client, token)
+
+	tok, err := result.ExtractToken()
+	if err != nil {
+		return nil, time.Time{}, nil
+	}
+
+	u, err := result.ExtractUser()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	roleNames := make([]string, 0, len(u.Roles))
+	for _, role := range u.Roles {
+		roleNames = append(roleNames, role.Name)
+	}
+
+	extra := map[string][]string{rolesExtraKey: roleNames}
+	if tok.Tenant.ID != "" {
+		extra[projectIDExtraKey] = []string{tok.Tenant.ID}
+	}
+
+	info := &user.DefaultInfo{
+		Name:   u.Name,
+		UID:    u.ID,
+		Groups: roleNames,
+		Extra:  extra,
+	}
+
+	return info, tok.ExpiresAt, nil
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	projectIDExtraKey = "alpha.kubernetes.io/identity/project/id"
+	rolesExtraKey     = "alpha.kubernetes.io/identity/roles"
+
+	// idpExtraKey and federatedGroupsExtraKey surface the identity
+	// provider and group memberships of tokens minted through Keystone's
+	// OIDC/SAML federation, so policyList rules can match on them.
+	idpExtraKey             = "openstack.org/idp"
+	federatedGroupsExtraKey = "openstack.org/federated-groups"
+)
+
+// Authorizer checks whether a user can perform an operation against the
+// policy list loaded from either a policy file or the kube-system
+// ConfigMap. The active policy list is held behind an atomic pointer so it
+// can be swapped in place by a background watch without taking a lock on
+// the hot authorization path.
+type Authorizer struct {
+	authURL string
+	client  identityClient
+
+	pl atomic.Value // holds policyList
+
+	cancel context.CancelFunc
+}
+
+var _ authorizer.Authorizer = &Authorizer{}
+
+func newAuthorizer(ctx context.Context, authURL string, client identityClient, policy policyList) (*Authorizer, context.Context) {
+	watchCtx, cancel := context.WithCancel(ctx)
+
+	a := &Authorizer{authURL: authURL, client: client, cancel: cancel}
+	a.setPolicy(policy)
+
+	return a, watchCtx
+}
+
+func (a *Authorizer) policy() policyList {
+	pl, _ := a.pl.Load().(policyList)
+	return pl
+}
+
+func (a *Authorizer) setPolicy(pl policyList) {
+	added, removed := a.policy().diffCounts(pl)
+	glog.V(2).Infof("Policy applied: %d rule(s) total (%d added, %d removed since previous load)", len(pl), added, removed)
+
+	output, err := json.MarshalIndent(pl, "", "  ")
+	if err == nil {
+		glog.V(6).Infof("Policy %s", string(output))
+	} else {
+		glog.V(6).Infof("Error %#v", err)
+	}
+
+	a.pl.Store(pl)
+}
+
+// Stop cancels the background watches started for this Authorizer, if any.
+func (a *Authorizer) Stop() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+// Authorize implements authorizer.Authorizer.
+func (a *Authorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	userInfo := attrs.GetUser()
+	extra := userInfo.GetExtra()
+
+	var projectID string
+	if v := extra[projectIDExtraKey]; len(v) > 0 {
+		projectID = v[0]
+	}
+
+	var idp string
+	if v := extra[idpExtraKey]; len(v) > 0 {
+		idp = v[0]
+	}
+
+	allowed := a.policy().matches(policyMatch{
+		userName:        userInfo.GetName(),
+		projectID:       projectID,
+		roles:           extra[rolesExtraKey],
+		resource:        attrs.GetResource(),
+		idp:             idp,
+		federatedGroups: extra[federatedGroupsExtraKey],
+	})
+	if allowed {
+		return authorizer.DecisionAllow, "", nil
+	}
+
+	return authorizer.DecisionNoOpinion, "no matching policy", nil
+}
+
+// watchPolicyFile reloads the policy list from path whenever the file
+// changes on disk. A failed parse leaves the previously loaded policy in
+// place.
+func watchPolicyFile(ctx context.Context, path string, a *Authorizer) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(path); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+
+				pl, err := newFromFile(path)
+				if err != nil {
+					glog.Warningf("keeping previous policy, failed to reload policy file %s: %v", path, err)
+					continue
+				}
+
+				a.setPolicy(pl)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Warningf("policy file watch error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// watchConfigMap keeps the Authorizer's policy list in sync with the
+// "policies" key of the kube-system ConfigMap named configMap, using a
+// reflector so edits take effect without restarting the webhook. A failed
+// parse leaves the previously loaded policy in place.
+func watchConfigMap(ctx context.Context, k8sClient kubernetes.Interface, configMap string, a *Authorizer) {
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", configMap).String()
+			return k8sClient.CoreV1().ConfigMaps("kube-system").List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", configMap).String()
+			return k8sClient.CoreV1().ConfigMaps("kube-system").Watch(options)
+		},
+	}
+
+	_, informer := cache.NewInformer(listWatch, &corev1.ConfigMap{}, 30*time.Second, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			reloadPolicyFromConfigMap(obj, configMap, a)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			reloadPolicyFromConfigMap(obj, configMap, a)
+		},
+	})
+
+	go informer.Run(ctx.Done())
+}
+
+func reloadPolicyFromConfigMap(obj interface{}, configMap string, a *Authorizer) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	var pl policyList
+	if err := json.Unmarshal([]byte(cm.Data["policies"]), &pl); err != nil {
+		glog.Warningf("keeping previous policy, failed to parse policies defined in the configmap %s: %v", configMap, err)
+		return
+	}
+
+	if err := pl.validate(); err != nil {
+		glog.Warningf("keeping previous policy, policies defined in the configmap %s are invalid: %v", configMap, err)
+		return
+	}
+
+	a.setPolicy(pl)
+}
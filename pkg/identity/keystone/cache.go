@@ -0,0 +1,136 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// negativeTokenCacheTTL bounds how long a token that failed validation is
+// remembered, just long enough to absorb a burst of retries for the same
+// bad token without hammering Keystone.
+const negativeTokenCacheTTL = 30 * time.Second
+
+var (
+	tokenCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "keystone_webhook",
+		Name:      "token_cache_hits_total",
+		Help:      "Number of TokenReview requests served from the token validation cache.",
+	})
+	tokenCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "keystone_webhook",
+		Name:      "token_cache_misses_total",
+		Help:      "Number of TokenReview requests that found no cached token validation at all.",
+	})
+	tokenCacheExpirations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "keystone_webhook",
+		Name:      "token_cache_expirations_total",
+		Help:      "Number of cached token validations that had to be recomputed after expiring.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(tokenCacheHits, tokenCacheMisses, tokenCacheExpirations)
+}
+
+// cachedTokenResult is the value stored in a tokenCache entry: either a
+// successfully validated identity, or a negative result remembered briefly
+// to absorb repeated lookups of an invalid token.
+type cachedTokenResult struct {
+	info  user.Info
+	valid bool
+}
+
+type tokenCacheEntry struct {
+	key       string
+	value     cachedTokenResult
+	expiresAt time.Time
+	elem      *list.Element
+}
+
+// tokenCache is a small LRU+TTL cache keyed by the SHA-256 of a bearer
+// token. It is bounded by item count and every entry additionally expires
+// after its own TTL, whichever comes first.
+type tokenCache struct {
+	mu       sync.Mutex
+	maxItems int
+	items    map[string]*tokenCacheEntry
+	order    *list.List // front = most recently used
+}
+
+func newTokenCache(maxItems int) *tokenCache {
+	return &tokenCache{
+		maxItems: maxItems,
+		items:    make(map[string]*tokenCacheEntry),
+		order:    list.New(),
+	}
+}
+
+func (c *tokenCache) get(key string) (cachedTokenResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.items[key]
+	if !ok {
+		tokenCacheMisses.Inc()
+		return cachedTokenResult{}, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		c.removeLocked(entry)
+		tokenCacheExpirations.Inc()
+		return cachedTokenResult{}, false
+	}
+
+	c.order.MoveToFront(entry.elem)
+	tokenCacheHits.Inc()
+	return entry.value, true
+}
+
+func (c *tokenCache) add(key string, value cachedTokenResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.items[key]; ok {
+		entry.value = value
+		entry.expiresAt = time.Now().Add(ttl)
+		c.order.MoveToFront(entry.elem)
+		return
+	}
+
+	entry := &tokenCacheEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)}
+	entry.elem = c.order.PushFront(entry)
+	c.items[key] = entry
+
+	for c.maxItems > 0 && len(c.items) > c.maxItems {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeLocked(oldest.Value.(*tokenCacheEntry))
+	}
+}
+
+func (c *tokenCache) removeLocked(entry *tokenCacheEntry) {
+	c.order.Remove(entry.elem)
+	delete(c.items, entry.key)
+}
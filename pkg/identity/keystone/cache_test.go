@@ -0,0 +1,124 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenCacheGetMiss(t *testing.T) {
+	c := newTokenCache(10)
+
+	if _, ok := c.get("missing"); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+}
+
+func TestTokenCacheAddAndGet(t *testing.T) {
+	c := newTokenCache(10)
+	c.add("key", cachedTokenResult{valid: true}, time.Minute)
+
+	got, ok := c.get("key")
+	if !ok {
+		t.Fatal("expected a hit after add")
+	}
+	if !got.valid {
+		t.Fatal("expected cached value to be valid")
+	}
+}
+
+func TestTokenCacheExpires(t *testing.T) {
+	c := newTokenCache(10)
+	c.add("key", cachedTokenResult{valid: true}, -time.Second)
+
+	if _, ok := c.get("key"); ok {
+		t.Fatal("expected entry with a TTL already in the past to be gone")
+	}
+}
+
+func TestTokenCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTokenCache(2)
+
+	c.add("a", cachedTokenResult{valid: true}, time.Minute)
+	c.add("b", cachedTokenResult{valid: true}, time.Minute)
+
+	// Touch "a" so "b" becomes the least recently used entry.
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a hit for \"a\"")
+	}
+
+	c.add("c", cachedTokenResult{valid: true}, time.Minute)
+
+	if _, ok := c.get("b"); ok {
+		t.Fatal("expected \"b\" to have been evicted as the least recently used entry")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected \"a\" to still be cached")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatal("expected \"c\" to be cached")
+	}
+}
+
+func TestCacheTTLForToken(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		maxTTL    time.Duration
+		want      time.Duration
+	}{
+		{
+			name:      "token outlives max TTL",
+			expiresAt: now.Add(time.Hour),
+			maxTTL:    10 * time.Minute,
+			want:      10 * time.Minute,
+		},
+		{
+			name:      "token expires before max TTL",
+			expiresAt: now.Add(2 * time.Minute),
+			maxTTL:    10 * time.Minute,
+			want:      2 * time.Minute,
+		},
+		{
+			name:      "token already expired",
+			expiresAt: now.Add(-time.Minute),
+			maxTTL:    10 * time.Minute,
+			want:      -time.Minute,
+		},
+		{
+			name:      "token expires exactly now",
+			expiresAt: now,
+			maxTTL:    10 * time.Minute,
+			want:      0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cacheTTLForToken(tt.expiresAt, tt.maxTTL, now)
+			if got != tt.want {
+				t.Fatalf("cacheTTLForToken() = %v, want %v", got, tt.want)
+			}
+			if got > tt.maxTTL {
+				t.Fatalf("cacheTTLForToken() = %v must never exceed maxTTL %v", got, tt.maxTTL)
+			}
+		})
+	}
+}
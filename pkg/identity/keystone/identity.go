@@ -0,0 +1,130 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/utils"
+)
+
+// identityClient is implemented by both the v2 and v3 identity service
+// clients so that the Authenticator/Authorizer token validation code paths
+// can work against either API once version negotiation has picked one.
+type identityClient interface {
+	// Version reports which Identity API version this client validates
+	// tokens against, "v2" or "v3".
+	Version() string
+	// ServiceClient returns the underlying gophercloud service client used
+	// to make identity API requests.
+	ServiceClient() *gophercloud.ServiceClient
+}
+
+type identityV2Client struct {
+	client *gophercloud.ServiceClient
+}
+
+func (c *identityV2Client) Version() string                           { return "v2" }
+func (c *identityV2Client) ServiceClient() *gophercloud.ServiceClient { return c.client }
+
+type identityV3Client struct {
+	client *gophercloud.ServiceClient
+}
+
+func (c *identityV3Client) Version() string                           { return "v3" }
+func (c *identityV3Client) ServiceClient() *gophercloud.ServiceClient { return c.client }
+
+// identityAPIVersions returns the version candidates ChooseVersion should
+// consider for the given pinned keystoneVersion ("v2", "v3" or "auto"/"").
+// Priority mirrors gophercloud's own defaults so that "auto" prefers v3
+// when a catalog advertises both.
+func identityAPIVersions(keystoneVersion string) ([]*utils.Version, error) {
+	v2 := &utils.Version{ID: "v2.0", Priority: 20, Suffix: "/v2.0/"}
+	v3 := &utils.Version{ID: "v3", Priority: 30, Suffix: "/v3/"}
+
+	switch keystoneVersion {
+	case "", "auto":
+		return []*utils.Version{v2, v3}, nil
+	case "v2":
+		return []*utils.Version{v2}, nil
+	case "v3":
+		return []*utils.Version{v3}, nil
+	default:
+		return nil, fmt.Errorf("unsupported keystone version %q, must be one of \"v2\", \"v3\" or \"auto\"", keystoneVersion)
+	}
+}
+
+// createIdentityProvider negotiates the Identity API version to use against
+// options.IdentityEndpoint, restricted to keystoneVersion when it is pinned
+// to "v2" or "v3", and returns the resulting provider client together with
+// the version that was chosen.
+func createIdentityProvider(options gophercloud.AuthOptions, transport http.RoundTripper, keystoneVersion string) (*gophercloud.ProviderClient, string, error) {
+	client, err := openstack.NewClient(options.IdentityEndpoint)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if transport != nil {
+		client.HTTPClient.Transport = transport
+	}
+
+	versions, err := identityAPIVersions(keystoneVersion)
+	if err != nil {
+		return nil, "", err
+	}
+
+	chosen, _, err := utils.ChooseVersion(client, versions)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to find a supported identity API version: %v", err)
+	}
+
+	return client, chosen.ID, nil
+}
+
+// createIdentityClient returns an identityClient wrapping a v2 or v3 service
+// client for chosenVersion, the version ID picked by createIdentityProvider.
+func createIdentityClient(provider *gophercloud.ProviderClient, chosenVersion string) (identityClient, error) {
+	switch chosenVersion {
+	case "v2.0":
+		client, err := openstack.NewIdentityV2(provider, gophercloud.EndpointOpts{})
+		if err != nil {
+			glog.Warningf("Failed: Unable to use keystone v2 identity service: %v", err)
+			return nil, fmt.Errorf("failed to authenticate")
+		}
+
+		return &identityV2Client{client: client}, nil
+	case "v3":
+		client, err := openstack.NewIdentityV3(provider, gophercloud.EndpointOpts{})
+		if err != nil {
+			glog.Warningf("Failed: Unable to use keystone v3 identity service: %v", err)
+			return nil, fmt.Errorf("failed to authenticate")
+		}
+
+		// Make sure we look under /v3 for resources.
+		client.IdentityBase = client.IdentityEndpoint
+		client.Endpoint = client.IdentityEndpoint
+
+		return &identityV3Client{client: client}, nil
+	default:
+		// The switch statement must be out of date from the versions list.
+		return nil, fmt.Errorf("unsupported identity API version: %s", chosenVersion)
+	}
+}
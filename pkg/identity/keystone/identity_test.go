@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import "testing"
+
+func TestIdentityAPIVersions(t *testing.T) {
+	tests := []struct {
+		name            string
+		keystoneVersion string
+		wantIDs         []string
+		wantErr         bool
+	}{
+		{name: "auto offers both v2 and v3", keystoneVersion: "auto", wantIDs: []string{"v2.0", "v3"}},
+		{name: "empty behaves like auto", keystoneVersion: "", wantIDs: []string{"v2.0", "v3"}},
+		{name: "pinned to v2", keystoneVersion: "v2", wantIDs: []string{"v2.0"}},
+		{name: "pinned to v3", keystoneVersion: "v3", wantIDs: []string{"v3"}},
+		{name: "unsupported version is an error", keystoneVersion: "bogus", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, err := identityAPIVersions(tt.keystoneVersion)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("identityAPIVersions(%q) = _, <nil>, want an error", tt.keystoneVersion)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("identityAPIVersions(%q) returned unexpected error: %v", tt.keystoneVersion, err)
+			}
+
+			if len(versions) != len(tt.wantIDs) {
+				t.Fatalf("identityAPIVersions(%q) returned %d versions, want %d", tt.keystoneVersion, len(versions), len(tt.wantIDs))
+			}
+			for i, id := range tt.wantIDs {
+				if versions[i].ID != id {
+					t.Fatalf("identityAPIVersions(%q)[%d].ID = %q, want %q", tt.keystoneVersion, i, versions[i].ID, id)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveAuthMethod(t *testing.T) {
+	tests := []struct {
+		name string
+		opts AuthOpts
+		want string
+	}{
+		{
+			name: "no credentials set falls back to empty",
+			opts: AuthOpts{},
+			want: "",
+		},
+		{
+			name: "default order prefers password over application credential",
+			opts: AuthOpts{
+				Username:                    "alice",
+				Password:                    "secret",
+				ApplicationCredentialID:     "app-id",
+				ApplicationCredentialSecret: "app-secret",
+			},
+			want: "password",
+		},
+		{
+			name: "falls back to application credential when password fields are incomplete",
+			opts: AuthOpts{
+				Username:                    "alice",
+				ApplicationCredentialID:     "app-id",
+				ApplicationCredentialSecret: "app-secret",
+			},
+			want: "application_credential",
+		},
+		{
+			name: "falls back to token when nothing else is populated",
+			opts: AuthOpts{TokenID: "tok"},
+			want: "token",
+		},
+		{
+			name: "explicit AuthMethods restricts the candidates considered",
+			opts: AuthOpts{
+				AuthMethods: []string{"token"},
+				Username:    "alice",
+				Password:    "secret",
+				TokenID:     "tok",
+			},
+			want: "token",
+		},
+		{
+			name: "explicit AuthMethods with no matching credentials falls back to empty",
+			opts: AuthOpts{
+				AuthMethods: []string{"application_credential"},
+				Username:    "alice",
+				Password:    "secret",
+			},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveAuthMethod(tt.opts); got != tt.want {
+				t.Fatalf("resolveAuthMethod(%+v) = %q, want %q", tt.opts, got, tt.want)
+			}
+		})
+	}
+}
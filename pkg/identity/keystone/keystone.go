@@ -17,16 +17,19 @@ limitations under the License.
 package keystone
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
-	"github.com/gophercloud/gophercloud/openstack/utils"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/extensions/trusts"
+	tokens3 "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	netutil "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/client-go/kubernetes"
@@ -34,32 +37,46 @@ import (
 	certutil "k8s.io/client-go/util/cert"
 )
 
-// Construct a Keystone v3 client, bail out if we cannot find the v3 API endpoint
-func createIdentityV3Provider(options gophercloud.AuthOptions, transport http.RoundTripper) (*gophercloud.ProviderClient, error) {
-	client, err := openstack.NewClient(options.IdentityEndpoint)
-	if err != nil {
-		return nil, err
-	}
+// AuthOpts holds everything needed to build a Keystone service client,
+// including the optional trust-scoped delegation credentials used when the
+// webhook must authenticate as a trustee rather than rely on unauthenticated
+// identity discovery.
+type AuthOpts struct {
+	AuthURL    string
+	CAFile     string
+	PolicyFile string
+	ConfigMap  string
+	KubeConfig string
 
-	if transport != nil {
-		client.HTTPClient.Transport = transport
-	}
+	// TrustID, when set, scopes the service client's token to the given
+	// trust. AuthOpts must then also carry the trustee's own credentials so
+	// the provider can authenticate against /v3/auth/tokens on its behalf.
+	TrustID string
 
-	versions := []*utils.Version{
-		{ID: "v3", Priority: 30, Suffix: "/v3/"},
-	}
-	chosen, _, err := utils.ChooseVersion(client, versions)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to find identity API v3 version : %v", err)
-	}
+	// KeystoneVersion pins the Identity API version to negotiate against:
+	// "v2", "v3", or "auto" (the default) to pick whichever the catalog's
+	// discovery document prefers.
+	KeystoneVersion string
 
-	switch chosen.ID {
-	case "v3":
-		return client, nil
-	default:
-		// The switch statement must be out of date from the versions list.
-		return nil, fmt.Errorf("Unsupported identity API version: %s", chosen.ID)
-	}
+	// AuthMethods lists, in preference order, which credentials the webhook
+	// may use to authenticate its own service client: "password",
+	// "application_credential", or "token". Defaults to trying all three,
+	// in that order, when unset.
+	AuthMethods []string
+
+	Username                    string
+	Password                    string
+	DomainName                  string
+	ApplicationCredentialID     string
+	ApplicationCredentialSecret string
+	TokenID                     string
+
+	// TokenCacheSize bounds how many validated tokens the Authenticator
+	// keeps cached at once (default 4096 when zero).
+	TokenCacheSize int
+	// TokenCacheMaxTTL bounds how long a validated token stays cached,
+	// never outliving the token's own expiry (default 10m when zero).
+	TokenCacheMaxTTL time.Duration
 }
 
 func createKubernetesClient(kubeConfig string) (*kubernetes.Clientset, error) {
@@ -84,17 +101,22 @@ func createKubernetesClient(kubeConfig string) (*kubernetes.Clientset, error) {
 	return client, nil
 }
 
-func createKeystoneClient(authURL string, caFile string) (*gophercloud.ServiceClient, error) {
+// createKeystoneClientFromAuthOpts negotiates an Identity API client,
+// pinned to opts.KeystoneVersion when set. When opts.TrustID is set, the
+// underlying provider is authenticated against /v3/auth/tokens as the
+// trustee described by opts, scoped to that trust, instead of being left
+// unauthenticated; trust scoping requires the v3 API.
+func createKeystoneClientFromAuthOpts(opts AuthOpts) (identityClient, error) {
 	// FIXME: Enable this check later
-	//if !strings.HasPrefix(authURL, "https") {
+	//if !strings.HasPrefix(opts.AuthURL, "https") {
 	//	return nil, errors.New("Auth URL should be secure and start with https")
 	//}
 	var transport http.RoundTripper
-	if authURL == "" {
+	if opts.AuthURL == "" {
 		return nil, errors.New("Auth URL is empty")
 	}
-	if caFile != "" {
-		roots, err := certutil.NewPool(caFile)
+	if opts.CAFile != "" {
+		roots, err := certutil.NewPool(opts.CAFile)
 		if err != nil {
 			return nil, err
 		}
@@ -102,43 +124,138 @@ func createKeystoneClient(authURL string, caFile string) (*gophercloud.ServiceCl
 		config.RootCAs = roots
 		transport = netutil.SetOldTransportDefaults(&http.Transport{TLSClientConfig: config})
 	}
-	opts := gophercloud.AuthOptions{IdentityEndpoint: authURL}
-	provider, err := createIdentityV3Provider(opts, transport)
+
+	if opts.TrustID != "" && opts.KeystoneVersion == "v2" {
+		return nil, errors.New("trust-scoped authentication requires keystone v3")
+	}
+
+	provider, chosenVersion, err := createIdentityProvider(gophercloud.AuthOptions{IdentityEndpoint: opts.AuthURL}, transport, opts.KeystoneVersion)
 	if err != nil {
 		return nil, err
 	}
 
-	// We should use the V3 API
-	client, err := openstack.NewIdentityV3(provider, gophercloud.EndpointOpts{})
-	if err != nil {
-		glog.Warningf("Failed: Unable to use keystone v3 identity service: %v", err)
-		return nil, errors.New("Failed to authenticate")
+	// Concurrent requests through the service client can each notice an
+	// expired token and try to reauthenticate; UseTokenLock serializes
+	// those attempts instead of racing them.
+	provider.UseTokenLock()
+
+	method := resolveAuthMethod(opts)
+	if opts.TrustID != "" || method != "" {
+		if chosenVersion != "v3" {
+			return nil, fmt.Errorf("authenticating the webhook's own service client requires keystone v3, catalog chose %s", chosenVersion)
+		}
+
+		ao := gophercloud.AuthOptions{IdentityEndpoint: opts.AuthURL}
+		switch method {
+		case "password":
+			ao.Username = opts.Username
+			ao.Password = opts.Password
+			ao.DomainName = opts.DomainName
+		case "application_credential":
+			ao.ApplicationCredentialID = opts.ApplicationCredentialID
+			ao.ApplicationCredentialSecret = opts.ApplicationCredentialSecret
+		case "token":
+			ao.TokenID = opts.TokenID
+		}
+
+		if opts.TrustID != "" {
+			trustAuthOpts := trusts.AuthOptsExt{
+				TrustID:            opts.TrustID,
+				AuthOptionsBuilder: tokens3.AuthOptions{AuthOptions: ao},
+			}
+			if err := openstack.AuthenticateV3(provider, trustAuthOpts, gophercloud.EndpointOpts{}); err != nil {
+				return nil, fmt.Errorf("failed to authenticate trust %s: %v", opts.TrustID, err)
+			}
+		} else {
+			if err := openstack.AuthenticateV3(provider, tokens3.AuthOptions{AuthOptions: ao}, gophercloud.EndpointOpts{}); err != nil {
+				return nil, fmt.Errorf("failed to authenticate service client using method %q: %v", method, err)
+			}
+		}
 	}
 
-	// Make sure we look under /v3 for resources
-	client.IdentityBase = client.IdentityEndpoint
-	client.Endpoint = client.IdentityEndpoint
-	return client, nil
+	return createIdentityClient(provider, chosenVersion)
+}
+
+// resolveAuthMethod picks which credential set the webhook itself should
+// use to authenticate against Keystone, honoring opts.AuthMethods' order
+// and falling back to trying password, then application credential, then a
+// pre-issued token when AuthMethods is unset. It returns "" when none of
+// the candidate methods have their required fields populated, in which
+// case the provider is left unauthenticated as before.
+func resolveAuthMethod(opts AuthOpts) string {
+	methods := opts.AuthMethods
+	if len(methods) == 0 {
+		methods = []string{"password", "application_credential", "token"}
+	}
+
+	for _, method := range methods {
+		switch method {
+		case "password":
+			if opts.Username != "" && opts.Password != "" {
+				return "password"
+			}
+		case "application_credential":
+			if opts.ApplicationCredentialID != "" && opts.ApplicationCredentialSecret != "" {
+				return "application_credential"
+			}
+		case "token":
+			if opts.TokenID != "" {
+				return "token"
+			}
+		}
+	}
+
+	return ""
 }
 
 // NewKeystoneAuthenticator returns a password authenticator that validates credentials using openstack keystone
-func NewKeystoneAuthenticator(authURL string, caFile string) (*Authenticator, error) {
-	client, err := createKeystoneClient(authURL, caFile)
+func NewKeystoneAuthenticator(authURL string, caFile string, keystoneVersion string) (*Authenticator, error) {
+	return NewKeystoneAuthenticatorFromConfig(AuthOpts{AuthURL: authURL, CAFile: caFile, KeystoneVersion: keystoneVersion})
+}
+
+// NewKeystoneAuthenticatorFromConfig returns a password authenticator built
+// from an AuthOpts struct, allowing callers to set up trust-scoped
+// authentication in addition to the plain authURL/caFile pair supported by
+// NewKeystoneAuthenticator.
+func NewKeystoneAuthenticatorFromConfig(opts AuthOpts) (*Authenticator, error) {
+	client, err := createKeystoneClientFromAuthOpts(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Authenticator{authURL: authURL, client: client}, nil
+	return newAuthenticator(opts.AuthURL, client, opts.TokenCacheSize, opts.TokenCacheMaxTTL), nil
 }
 
-// NewKeystoneAuthorizer returns a password authorizer that checks whether the user can perform an operation
-func NewKeystoneAuthorizer(authURL string, caFile string, policyFile string, configMap string, kubeConfig string) (*Authorizer, error) {
-	client, err := createKeystoneClient(authURL, caFile)
+// NewKeystoneAuthorizer returns a password authorizer that checks whether
+// the user can perform an operation. The returned Authorizer keeps its
+// policy list up to date for as long as ctx is not cancelled; callers
+// should call Authorizer.Stop (or cancel ctx) when the webhook shuts down.
+func NewKeystoneAuthorizer(ctx context.Context, authURL string, caFile string, policyFile string, configMap string, kubeConfig string, keystoneVersion string) (*Authorizer, error) {
+	return NewKeystoneAuthorizerFromConfig(ctx, AuthOpts{
+		AuthURL:         authURL,
+		CAFile:          caFile,
+		PolicyFile:      policyFile,
+		ConfigMap:       configMap,
+		KubeConfig:      kubeConfig,
+		KeystoneVersion: keystoneVersion,
+	})
+}
+
+// NewKeystoneAuthorizerFromConfig returns a password authorizer built from an
+// AuthOpts struct, allowing callers to set up trust-scoped authentication in
+// addition to the policy source settings supported by NewKeystoneAuthorizer.
+func NewKeystoneAuthorizerFromConfig(ctx context.Context, opts AuthOpts) (*Authorizer, error) {
+	policyFile := opts.PolicyFile
+	configMap := opts.ConfigMap
+	kubeConfig := opts.KubeConfig
+
+	client, err := createKeystoneClientFromAuthOpts(opts)
 	if err != nil {
 		return nil, err
 	}
 
 	var policy policyList
+	var k8sClient *kubernetes.Clientset
 
 	if policyFile != "" {
 		policy, err = newFromFile(policyFile)
@@ -146,7 +263,7 @@ func NewKeystoneAuthorizer(authURL string, caFile string, policyFile string, con
 			return nil, fmt.Errorf("failed to extract policy from policy file %s: %v", policyFile, err)
 		}
 	} else if configMap != "" {
-		k8sClient, err := createKubernetesClient(kubeConfig)
+		k8sClient, err = createKubernetesClient(kubeConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -159,16 +276,23 @@ func NewKeystoneAuthorizer(authURL string, caFile string, policyFile string, con
 		if err := json.Unmarshal([]byte(cm.Data["policies"]), &policy); err != nil {
 			return nil, fmt.Errorf("failed to parse policies defined in the configmap %s: %v", configMap, err)
 		}
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("invalid policies defined in the configmap %s: %v", configMap, err)
+		}
 	} else {
 		return nil, nil
 	}
 
-	output, err := json.MarshalIndent(policy, "", "  ")
-	if err == nil {
-		glog.V(6).Infof("Policy %s", string(output))
+	a, watchCtx := newAuthorizer(ctx, opts.AuthURL, client, policy)
+
+	if policyFile != "" {
+		if err := watchPolicyFile(watchCtx, policyFile, a); err != nil {
+			a.Stop()
+			return nil, fmt.Errorf("failed to watch policy file %s: %v", policyFile, err)
+		}
 	} else {
-		glog.V(6).Infof("Error %#v", err)
+		watchConfigMap(watchCtx, k8sClient, configMap, a)
 	}
 
-	return &Authorizer{authURL: authURL, client: client, pl: policy}, nil
+	return a, nil
 }
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// policy describes a single authorization rule loaded either from a policy
+// file or from the kube-system ConfigMap. A SubjectAccessReview is allowed
+// when at least one policy in the list matches the requesting user, project
+// and roles for the resource being accessed.
+type policy struct {
+	Resource string   `json:"resource,omitempty"`
+	Project  string   `json:"project,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Role     []string `json:"role,omitempty"`
+
+	// IdP and FederatedGroup match tokens minted through Keystone's
+	// OIDC/SAML federation, letting a policy authorize an external
+	// identity provider or group without knowing individual usernames.
+	IdP            string   `json:"idp,omitempty"`
+	FederatedGroup []string `json:"federatedGroup,omitempty"`
+}
+
+type policyList []*policy
+
+// policyMatch carries the request attributes a policy is evaluated
+// against.
+type policyMatch struct {
+	userName        string
+	projectID       string
+	roles           []string
+	resource        string
+	idp             string
+	federatedGroups []string
+}
+
+// newFromFile reads and parses a policy list from a JSON file on disk.
+func newFromFile(path string) (policyList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pl policyList
+	if err := json.Unmarshal(data, &pl); err != nil {
+		return nil, err
+	}
+
+	if err := pl.validate(); err != nil {
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+// validate reports whether pl is safe to activate. It rejects an empty
+// list, since that almost always means a truncated ConfigMap or a botched
+// edit rather than an intentional lockdown, and rejects any entry with no
+// criteria set at all, since such an entry matches every request and would
+// silently authorize everything regardless of the other rules.
+func (pl policyList) validate() error {
+	if len(pl) == 0 {
+		return errors.New("policy list is empty")
+	}
+
+	for i, p := range pl {
+		if p.Resource == "" && p.Project == "" && p.User == "" && len(p.Role) == 0 && p.IdP == "" && len(p.FederatedGroup) == 0 {
+			return fmt.Errorf("policy %d has no criteria set and would match every request", i)
+		}
+	}
+
+	return nil
+}
+
+// diffCounts reports how many rules were added and removed going from pl
+// (the previous policy) to next, so a reload can be logged as a summary
+// instead of requiring an operator to diff the raw policy JSON by hand.
+func (pl policyList) diffCounts(next policyList) (added, removed int) {
+	before := make(map[string]int, len(pl))
+	for _, p := range pl {
+		before[p.key()]++
+	}
+
+	after := make(map[string]int, len(next))
+	for _, p := range next {
+		after[p.key()]++
+	}
+
+	for k, n := range after {
+		if d := n - before[k]; d > 0 {
+			added += d
+		}
+	}
+	for k, n := range before {
+		if d := n - after[k]; d > 0 {
+			removed += d
+		}
+	}
+
+	return added, removed
+}
+
+// key returns a canonical representation of p suitable for equality
+// comparisons in diffCounts.
+func (p *policy) key() string {
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+// matches reports whether any policy in the list authorizes m.
+func (pl policyList) matches(m policyMatch) bool {
+	for _, p := range pl {
+		if p.Resource != "" && p.Resource != m.resource {
+			continue
+		}
+		if p.Project != "" && p.Project != m.projectID {
+			continue
+		}
+		if p.User != "" && p.User != m.userName {
+			continue
+		}
+		if len(p.Role) > 0 && !hasAny(m.roles, p.Role) {
+			continue
+		}
+		if p.IdP != "" && p.IdP != m.idp {
+			continue
+		}
+		if len(p.FederatedGroup) > 0 && !hasAny(m.federatedGroups, p.FederatedGroup) {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+func hasAny(have []string, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystone
+
+import "testing"
+
+func TestPolicyListMatches(t *testing.T) {
+	pl := policyList{
+		{Resource: "pods", Project: "proj-a", Role: []string{"admin"}},
+		{Resource: "nodes", User: "alice"},
+		{IdP: "okta", FederatedGroup: []string{"sre"}},
+	}
+
+	tests := []struct {
+		name  string
+		match policyMatch
+		want  bool
+	}{
+		{
+			name:  "resource, project and role all match",
+			match: policyMatch{resource: "pods", projectID: "proj-a", roles: []string{"admin"}},
+			want:  true,
+		},
+		{
+			name:  "right resource and project but missing role",
+			match: policyMatch{resource: "pods", projectID: "proj-a", roles: []string{"member"}},
+			want:  false,
+		},
+		{
+			name:  "right resource but wrong project",
+			match: policyMatch{resource: "pods", projectID: "proj-b", roles: []string{"admin"}},
+			want:  false,
+		},
+		{
+			name:  "user-scoped policy matches regardless of project",
+			match: policyMatch{resource: "nodes", userName: "alice"},
+			want:  true,
+		},
+		{
+			name:  "user-scoped policy does not match a different user",
+			match: policyMatch{resource: "nodes", userName: "bob"},
+			want:  false,
+		},
+		{
+			name:  "federated identity matches on idp and group",
+			match: policyMatch{idp: "okta", federatedGroups: []string{"sre", "other"}},
+			want:  true,
+		},
+		{
+			name:  "federated identity with wrong idp does not match",
+			match: policyMatch{idp: "ping", federatedGroups: []string{"sre"}},
+			want:  false,
+		},
+		{
+			name:  "federated identity missing the required group does not match",
+			match: policyMatch{idp: "okta", federatedGroups: []string{"other"}},
+			want:  false,
+		},
+		{
+			name:  "nothing matches an unrelated resource",
+			match: policyMatch{resource: "secrets"},
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pl.matches(tt.match); got != tt.want {
+				t.Fatalf("policyList.matches(%+v) = %v, want %v", tt.match, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyListValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		pl      policyList
+		wantErr bool
+	}{
+		{
+			name:    "empty list is rejected",
+			pl:      policyList{},
+			wantErr: true,
+		},
+		{
+			name:    "entry with no criteria is rejected",
+			pl:      policyList{{Resource: "pods"}, {}},
+			wantErr: true,
+		},
+		{
+			name:    "well-formed list is accepted",
+			pl:      policyList{{Resource: "pods", Project: "proj-a"}, {User: "alice"}},
+			wantErr: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pl.validate()
+			if tt.wantErr && err == nil {
+				t.Fatalf("policyList.validate() = <nil>, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("policyList.validate() returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPolicyListDiffCounts(t *testing.T) {
+	before := policyList{
+		{Resource: "pods", Project: "proj-a"},
+		{Resource: "nodes", User: "alice"},
+	}
+	after := policyList{
+		{Resource: "pods", Project: "proj-a"},
+		{Resource: "secrets", User: "bob"},
+	}
+
+	added, removed := before.diffCounts(after)
+	if added != 1 {
+		t.Fatalf("diffCounts() added = %d, want 1", added)
+	}
+	if removed != 1 {
+		t.Fatalf("diffCounts() removed = %d, want 1", removed)
+	}
+}
+
+func TestHasAny(t *testing.T) {
+	tests := []struct {
+		name string
+		have []string
+		want []string
+		ok   bool
+	}{
+		{name: "overlap", have: []string{"a", "b"}, want: []string{"b", "c"}, ok: true},
+		{name: "no overlap", have: []string{"a"}, want: []string{"b"}, ok: false},
+		{name: "empty have", have: nil, want: []string{"a"}, ok: false},
+		{name: "empty want", have: []string{"a"}, want: nil, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasAny(tt.have, tt.want); got != tt.ok {
+				t.Fatalf("hasAny(%v, %v) = %v, want %v", tt.have, tt.want, got, tt.ok)
+			}
+		})
+	}
+}